@@ -2,7 +2,6 @@ package golesali
 
 import (
     "io"
-    "log"
     "bytes"
     "errors"
     "encoding/binary"
@@ -15,7 +14,13 @@ const Major = 0
 const Minor = 2
 
 // PROTOCOL VERSION
-const PROTOCOL_VERSION = 1
+//
+// Bumped to 2 when HandleRequest started prefixing every response with an
+// envelope-kind marker byte (see envelopeKindStripped/envelopeKindStreaming
+// below) so it can emit streaming envelopes for large responses. A
+// PROTOCOL_VERSION 1 client does not expect that byte and will fail to open
+// the response; this is a breaking wire change, not an additive one.
+const PROTOCOL_VERSION = 2
 
 // BUFFER LENGTHS
 const K_SZ = 32 // key size in bytes
@@ -28,17 +33,45 @@ msgNumber uint64) (context.Context, *[32]byte, error)
 
 type UpdateNonceFunc func(ctx context.Context, pk *[32]byte,
 msgNumber uint64) error
+// CheckNonceFunc is consulted before any decryption happens, so a replayed
+// ciphertext can be rejected without paying for a Curve25519/box operation.
+// It must not mutate state that UpdateNonceFunc also mutates for the same
+// message: CheckNonceFunc runs on every incoming message, including ones
+// that never make it past decryption, while UpdateNonceFunc only runs once
+// a message has been authenticated.
+type CheckNonceFunc func(ctx context.Context, pk *[32]byte,
+msgNumber uint64) error
 type RequestHandlerFunc func(ctx context.Context, msg io.Reader,
 response io.Writer) error
 type PaddingSizeFunc func(int) (int, byte)
 
 type ClientServerDispatcher struct {
     EstablishContext EstablishContextFunc
+    CheckNonce CheckNonceFunc
     UpdateNonce UpdateNonceFunc
     RequestHandler RequestHandlerFunc
     GetPaddingSize PaddingSizeFunc
+    // StreamingThreshold is the plaintext response size above which
+    // HandleRequest seals the response as a streaming envelope instead of a
+    // single stripped one. Zero selects DefaultStreamingThreshold.
+    StreamingThreshold int
 }
 
+// DefaultStreamingThreshold is the StreamingThreshold used when a
+// ClientServerDispatcher leaves it at zero.
+const DefaultStreamingThreshold = 1 << 20 // 1 MiB
+
+// envelope kind markers prefixed to both the request body and the
+// HandleRequest response so each side knows whether to read it back as a
+// single sealed box or with OpenStreamingEnvelope. This prefix is new as of
+// PROTOCOL_VERSION 2 and is present on every request/response, not just
+// streamed ones: a PROTOCOL_VERSION 1 peer does not know to strip it and
+// cannot talk to a PROTOCOL_VERSION 2 one, or vice versa.
+const (
+    envelopeKindStripped byte = 0
+    envelopeKindStreaming byte = 1
+)
+
 // ## DEFAULT FUNCTIONS ## 
 func DefaultPaddingSize(plainLen int) (int, byte) {
     mask := 1
@@ -89,7 +122,7 @@ padding byte, msgNumber uint64) error {
     for i := 0; i < int(padding); i++ { paddingBuf[i] = padding }
     plainBuf.Write(paddingBuf)
 
-    binary.BigEndian.PutUint64(nonce[N_SZ - LN_SZ:], msgNumber)
+    binary.BigEndian.PutUint64(nonce[N_SZ - 8:], msgNumber)
 
     cipher = box.SealAfterPrecomputation(cipher[:], plainBuf.Bytes(),
         &nonce, ss)
@@ -120,6 +153,7 @@ responseWriter io.Writer, requestReader io.Reader) error {
     var (
         pk [K_SZ]byte
         nonce [N_SZ]byte
+        kind [1]byte
         plain []byte
         requestBuffer bytes.Buffer
         plainResponseBuffer bytes.Buffer
@@ -132,25 +166,42 @@ responseWriter io.Writer, requestReader io.Reader) error {
     // extract nonce from request
     _, err = requestReader.Read(nonce[N_SZ-LN_SZ:])
     if err != nil { return err }
+    // extract envelope-kind marker from request
+    _, err = requestReader.Read(kind[:])
+    if err != nil { return err }
 
     // call GetChannelState
     intNonce := binary.BigEndian.Uint64(nonce[N_SZ-8:])
     if intNonce % 2 != 0 { return errors.New(
         "Incoming requests must have an even message number.") }
 
+    // reject replays before spending anything on the Curve25519/box work
+    // below
+    if csd.CheckNonce != nil {
+        if err := csd.CheckNonce(ctx, &pk, intNonce); err != nil { return err }
+    }
+
     newCtx, ss, err := csd.EstablishContext(ctx, &pk, intNonce)
     if err != nil { return err }
 
-    io.Copy(&requestBuffer, requestReader)
-    // decrypt
-    plain, success := box.OpenAfterPrecomputation(plain, requestBuffer.Bytes(),
-    &nonce, ss)
-    if false == success { return errors.New("Authentication error.") }
+    var stripped_plain []byte
+    if kind[0] == envelopeKindStreaming {
+        var reqPlainBuffer bytes.Buffer
+        if err := OpenStreamingEnvelope(requestReader, &reqPlainBuffer, ss,
+        intNonce, 0); err != nil { return err }
+        stripped_plain = reqPlainBuffer.Bytes()
+    } else {
+        io.Copy(&requestBuffer, requestReader)
+        // decrypt
+        plain, success := box.OpenAfterPrecomputation(plain, requestBuffer.Bytes(),
+        &nonce, ss)
+        if false == success { return errors.New("Authentication error.") }
 
-    if err := csd.UpdateNonce(newCtx, &pk, intNonce); err != nil { return err }
+        stripped_plain, err = StripPadding(plain)
+        if err != nil { return err }
+    }
 
-    stripped_plain, err := StripPadding(plain)
-    if err != nil { return err }
+    if err := csd.UpdateNonce(newCtx, &pk, intNonce); err != nil { return err }
 
     // call handleRequest
     strippedBuf := bytes.NewBuffer(stripped_plain)
@@ -158,18 +209,28 @@ responseWriter io.Writer, requestReader io.Reader) error {
     &plainResponseBuffer); err != nil { return err }
 
     binary.BigEndian.PutUint64(nonce[N_SZ-8:], intNonce+1)
+    respNonce := binary.BigEndian.Uint64(nonce[N_SZ-8:])
 
-    // seal stripped envelope
+    threshold := csd.StreamingThreshold
+    if threshold <= 0 { threshold = DefaultStreamingThreshold }
 
+    if plainResponseBuffer.Len() > threshold {
+        // seal streaming envelope: padding is applied per frame, so it is
+        // not added up front here.
+        responseWriter.Write([]byte{envelopeKindStreaming})
+        return SealStreamingEnvelope(responseWriter, &plainResponseBuffer, ss,
+            respNonce, 0)
+    }
+
+    // seal stripped envelope
     _, padding := DefaultPaddingSize(plainResponseBuffer.Len())
     paddingBuf := make([]byte, int(padding))
     for i := 0; i < int(padding); i++ { paddingBuf[i] = padding }
     plainResponseBuffer.Write(paddingBuf)
 
-    plainResponseBytes := plainResponseBuffer.Bytes()
-    log.Println(plainResponseBytes)
     cipher_response = box.SealAfterPrecomputation(cipher_response,
     plainResponseBuffer.Bytes(), &nonce, ss)
+    responseWriter.Write([]byte{envelopeKindStripped})
     responseWriter.Write(cipher_response[:])
 
     return nil;
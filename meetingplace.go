@@ -0,0 +1,244 @@
+package golesali
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/base64"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io/ioutil"
+    "net/http"
+    "sync"
+    "time"
+    "golang.org/x/crypto/nacl/secretbox"
+    "golang.org/x/net/context"
+)
+
+// ## MEETING PLACE ##
+//
+// EstablishContext assumes the two parties already know each other's
+// Curve25519 public key. MeetingPlace is for the step before that: two
+// parties who only share a low-entropy secret rendezvous at a point derived
+// from it, exchange sealed blobs through an untrusted transport, and
+// recover each other's real public keys (the PANDA pattern).
+
+// meetingIDLabel/meetingEncryptLabel separate the meeting-id derivation
+// from the encryption-key derivation, so neither value can be recovered
+// from the other.
+const (
+    meetingIDLabel      = "meeting"
+    meetingEncryptLabel = "encrypt"
+)
+
+// DeriveMeetingParams derives the public meeting point and the symmetric
+// key used to seal blobs posted there from a passphrase shared out of band
+// by the two parties. Both sides must call this with the same passphrase.
+func DeriveMeetingParams(passphrase []byte) (meetingID [K_SZ]byte, sharedKey [K_SZ]byte) {
+    meetingID = meetingKDF(passphrase, meetingIDLabel)
+    sharedKey = meetingKDF(passphrase, meetingEncryptLabel)
+    return
+}
+
+func meetingKDF(passphrase []byte, label string) [K_SZ]byte {
+    mac := hmac.New(sha256.New, passphrase)
+    mac.Write([]byte(label))
+    var out [K_SZ]byte
+    copy(out[:], mac.Sum(nil))
+    return out
+}
+
+// MeetingTransport is the pluggable, untrusted channel blobs are posted to
+// and polled from. It need not be confidential or authenticated: that's
+// what sharedKey is for.
+type MeetingTransport interface {
+    Post(ctx context.Context, meetingID [K_SZ]byte, blob []byte) error
+    Poll(ctx context.Context, meetingID [K_SZ]byte) ([][]byte, error)
+}
+
+// MeetingPlace drives the Exchange protocol over a MeetingTransport.
+type MeetingPlace struct {
+    Transport    MeetingTransport
+    SharedKey    [K_SZ]byte
+    PollInterval time.Duration
+}
+
+// NewMeetingPlace builds a MeetingPlace from a transport and the sharedKey
+// returned by DeriveMeetingParams.
+func NewMeetingPlace(transport MeetingTransport, sharedKey *[K_SZ]byte) *MeetingPlace {
+    return &MeetingPlace{
+        Transport:    transport,
+        SharedKey:    *sharedKey,
+        PollInterval: 500 * time.Millisecond,
+    }
+}
+
+// Exchange seals myMessage under mp.SharedKey, posts it at meetingID, and
+// polls the transport until the peer's blob shows up, returning its opened
+// contents (typically the peer's real Curve25519 public key plus whatever
+// intro payload the caller included). A wrong shared passphrase, or an
+// attacker without it, surfaces as an authentication error rather than
+// garbage plaintext.
+func (mp *MeetingPlace) Exchange(ctx context.Context, meetingID [K_SZ]byte,
+myMessage []byte) ([]byte, error) {
+    myBlob, err := sealMeetingBlob(&mp.SharedKey, myMessage)
+    if err != nil { return nil, err }
+
+    if err := mp.Transport.Post(ctx, meetingID, myBlob); err != nil { return nil, err }
+
+    interval := mp.PollInterval
+    if interval <= 0 { interval = 500 * time.Millisecond }
+
+    for {
+        blobs, err := mp.Transport.Poll(ctx, meetingID)
+        if err != nil { return nil, err }
+
+        if len(blobs) > 2 {
+            return nil, errors.New("meeting place collision: more than two parties posted to this meeting id.")
+        }
+
+        for _, blob := range blobs {
+            if bytes.Equal(blob, myBlob) { continue }
+            return openMeetingBlob(&mp.SharedKey, blob)
+        }
+
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        case <-time.After(interval):
+        }
+    }
+}
+
+func sealMeetingBlob(sharedKey *[K_SZ]byte, message []byte) ([]byte, error) {
+    var nonce [N_SZ]byte
+    if _, err := rand.Read(nonce[:]); err != nil { return nil, err }
+    sealed := secretbox.Seal(nil, message, &nonce, sharedKey)
+    return append(nonce[:], sealed...), nil
+}
+
+func openMeetingBlob(sharedKey *[K_SZ]byte, blob []byte) ([]byte, error) {
+    if len(blob) < N_SZ { return nil, errors.New("malformed meeting blob.") }
+    var nonce [N_SZ]byte
+    copy(nonce[:], blob[:N_SZ])
+    message, success := secretbox.Open(nil, blob[N_SZ:], &nonce, sharedKey)
+    if !success { return nil, errors.New("Authentication error.") }
+    return message, nil
+}
+
+// ## IN-MEMORY TRANSPORT ##
+//
+// MemoryMeetingTransport is a MeetingTransport backed by a map, for tests
+// and same-process rendezvous. It enforces the same two-blobs-per-meeting
+// limit a real meeting-place server would, and rejects a byte-for-byte
+// duplicate of an already-posted blob so an eavesdropper can't replay the
+// victim's own post to consume the second slot: Exchange tells its own
+// blob apart from the peer's by content, so a replayed duplicate would
+// otherwise be silently filtered out by both sides and the real second
+// party would be locked out with a collision error.
+type MemoryMeetingTransport struct {
+    mu    sync.Mutex
+    blobs map[[K_SZ]byte][][]byte
+}
+
+func NewMemoryMeetingTransport() *MemoryMeetingTransport {
+    return &MemoryMeetingTransport{blobs: make(map[[K_SZ]byte][][]byte)}
+}
+
+func (t *MemoryMeetingTransport) Post(ctx context.Context, meetingID [K_SZ]byte,
+blob []byte) error {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    existing := t.blobs[meetingID]
+    if len(existing) >= 2 {
+        return errors.New("meeting place collision: more than two parties posted to this meeting id.")
+    }
+    for _, b := range existing {
+        if bytes.Equal(b, blob) {
+            return errors.New("meeting place collision: duplicate blob already posted to this meeting id.")
+        }
+    }
+    t.blobs[meetingID] = append(existing, blob)
+    return nil
+}
+
+func (t *MemoryMeetingTransport) Poll(ctx context.Context, meetingID [K_SZ]byte) ([][]byte, error) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+
+    return append([][]byte(nil), t.blobs[meetingID]...), nil
+}
+
+// ## HTTP-BACKED TRANSPORT ##
+//
+// HTTPMeetingTransport talks to a meeting-place server reachable at BaseURL,
+// POSTing and GETting base64-encoded blobs under the hex-encoded meeting id.
+// The server is expected to enforce the same two-blobs and
+// no-duplicate-blob rules as MemoryMeetingTransport.Post.
+type HTTPMeetingTransport struct {
+    BaseURL string
+    Client  *http.Client
+}
+
+func NewHTTPMeetingTransport(baseURL string) *HTTPMeetingTransport {
+    return &HTTPMeetingTransport{BaseURL: baseURL, Client: http.DefaultClient}
+}
+
+func (t *HTTPMeetingTransport) url(meetingID [K_SZ]byte) string {
+    return t.BaseURL + "/" + hex.EncodeToString(meetingID[:])
+}
+
+func (t *HTTPMeetingTransport) Post(ctx context.Context, meetingID [K_SZ]byte,
+blob []byte) error {
+    body, err := json.Marshal(base64.StdEncoding.EncodeToString(blob))
+    if err != nil { return err }
+
+    req, err := http.NewRequest("POST", t.url(meetingID), bytes.NewReader(body))
+    if err != nil { return err }
+    req = req.WithContext(ctx)
+
+    resp, err := t.client().Do(req)
+    if err != nil { return err }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+        return errors.New("meeting place server rejected post: " + resp.Status)
+    }
+    return nil
+}
+
+func (t *HTTPMeetingTransport) Poll(ctx context.Context, meetingID [K_SZ]byte) ([][]byte, error) {
+    req, err := http.NewRequest("GET", t.url(meetingID), nil)
+    if err != nil { return nil, err }
+    req = req.WithContext(ctx)
+
+    resp, err := t.client().Do(req)
+    if err != nil { return nil, err }
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return nil, errors.New("meeting place server error: " + resp.Status)
+    }
+
+    data, err := ioutil.ReadAll(resp.Body)
+    if err != nil { return nil, err }
+
+    var encoded []string
+    if err := json.Unmarshal(data, &encoded); err != nil { return nil, err }
+
+    blobs := make([][]byte, len(encoded))
+    for i, e := range encoded {
+        blob, err := base64.StdEncoding.DecodeString(e)
+        if err != nil { return nil, err }
+        blobs[i] = blob
+    }
+    return blobs, nil
+}
+
+func (t *HTTPMeetingTransport) client() *http.Client {
+    if t.Client != nil { return t.Client }
+    return http.DefaultClient
+}
@@ -0,0 +1,93 @@
+package golesali
+
+import (
+    "testing"
+    "golang.org/x/net/context"
+)
+
+func TestMeetingPlaceExchangeRoundTrip(t *testing.T) {
+    _, sharedKey := DeriveMeetingParams([]byte("correct horse battery staple"))
+    meetingID, _ := DeriveMeetingParams([]byte("correct horse battery staple"))
+
+    transport := NewMemoryMeetingTransport()
+    alice := NewMeetingPlace(transport, &sharedKey)
+    bob := NewMeetingPlace(transport, &sharedKey)
+
+    type result struct {
+        msg []byte
+        err error
+    }
+    aliceDone := make(chan result, 1)
+    bobDone := make(chan result, 1)
+
+    go func() {
+        msg, err := alice.Exchange(context.Background(), meetingID, []byte("alice's pubkey"))
+        aliceDone <- result{msg, err}
+    }()
+    go func() {
+        msg, err := bob.Exchange(context.Background(), meetingID, []byte("bob's pubkey"))
+        bobDone <- result{msg, err}
+    }()
+
+    aliceResult := <-aliceDone
+    bobResult := <-bobDone
+
+    if aliceResult.err != nil { t.Fatalf("alice.Exchange: %v", aliceResult.err) }
+    if bobResult.err != nil { t.Fatalf("bob.Exchange: %v", bobResult.err) }
+
+    if string(aliceResult.msg) != "bob's pubkey" {
+        t.Fatalf("alice got %q, want %q", aliceResult.msg, "bob's pubkey")
+    }
+    if string(bobResult.msg) != "alice's pubkey" {
+        t.Fatalf("bob got %q, want %q", bobResult.msg, "alice's pubkey")
+    }
+}
+
+func TestMeetingPlaceWrongPassphraseFailsAuthentication(t *testing.T) {
+    _, aliceKey := DeriveMeetingParams([]byte("correct horse battery staple"))
+    meetingID, _ := DeriveMeetingParams([]byte("correct horse battery staple"))
+    _, eveKey := DeriveMeetingParams([]byte("wrong guess"))
+
+    transport := NewMemoryMeetingTransport()
+
+    blob, err := sealMeetingBlob(&aliceKey, []byte("alice's pubkey"))
+    if err != nil { t.Fatalf("sealMeetingBlob: %v", err) }
+    if err := transport.Post(context.Background(), meetingID, blob); err != nil {
+        t.Fatalf("Post: %v", err)
+    }
+
+    eve := NewMeetingPlace(transport, &eveKey)
+
+    // alice's blob is already posted, so eve's own Exchange call finds it on
+    // its first Poll without needing to wait.
+    if _, err := eve.Exchange(context.Background(), meetingID, []byte("eve's pubkey")); err == nil {
+        t.Fatal("expected a wrong shared key to fail authentication rather than return garbage")
+    }
+}
+
+// TestMeetingPlaceRejectsDuplicateBlob confirms an eavesdropper can't replay
+// alice's own posted blob to consume the second meeting-id slot: that would
+// leave bob's genuine post rejected as a collision, and alice's Exchange
+// loop polling forever since it filters out both copies of its own blob.
+func TestMeetingPlaceRejectsDuplicateBlob(t *testing.T) {
+    _, sharedKey := DeriveMeetingParams([]byte("correct horse battery staple"))
+    meetingID, _ := DeriveMeetingParams([]byte("correct horse battery staple"))
+
+    transport := NewMemoryMeetingTransport()
+
+    blob, err := sealMeetingBlob(&sharedKey, []byte("alice's pubkey"))
+    if err != nil { t.Fatalf("sealMeetingBlob: %v", err) }
+    if err := transport.Post(context.Background(), meetingID, blob); err != nil {
+        t.Fatalf("alice's Post: %v", err)
+    }
+
+    // eve observed alice's blob on the wire and replays it verbatim.
+    if err := transport.Post(context.Background(), meetingID, append([]byte(nil), blob...)); err == nil {
+        t.Fatal("expected a replayed duplicate blob to be rejected")
+    }
+
+    bob := NewMeetingPlace(transport, &sharedKey)
+    if _, err := bob.Exchange(context.Background(), meetingID, []byte("bob's pubkey")); err != nil {
+        t.Fatalf("bob.Exchange should still succeed after the replay was rejected: %v", err)
+    }
+}
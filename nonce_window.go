@@ -0,0 +1,110 @@
+package golesali
+
+import (
+    "errors"
+    "sync"
+    "golang.org/x/net/context"
+)
+
+// ## REPLAY / NONCE WINDOW ##
+//
+// SlidingWindow is the default CheckNonceFunc/UpdateNonceFunc pair: it
+// accepts a message number strictly greater than the highest seen for that
+// public key, or within maxWindow of it and not already marked accepted,
+// the same sliding-bitmap policy IPsec and WireGuard use against replay.
+// maxWindow is 64 since the per-peer state is a single uint64 bitmap;
+// DefaultWindowSize's 128 is silently clamped to it.
+const DefaultWindowSize = 128
+const maxWindow = 64
+
+type nonceWindowState struct {
+    seen    bool
+    highest uint64
+    bitmap  uint64
+}
+
+// SlidingWindow tracks, per public key, the highest message number accepted
+// and a bitmap of which of the maxWindow numbers below it have already been
+// accepted. Use Check as a CheckNonceFunc and Update as an UpdateNonceFunc.
+type SlidingWindow struct {
+    mu     sync.Mutex
+    window uint64
+    state  map[[K_SZ]byte]*nonceWindowState
+}
+
+// NewSlidingWindow builds a SlidingWindow accepting message numbers within w
+// of the highest seen per public key. w <= 0 selects DefaultWindowSize; w is
+// capped at maxWindow regardless.
+func NewSlidingWindow(w int) *SlidingWindow {
+    if w <= 0 { w = DefaultWindowSize }
+    if w > maxWindow { w = maxWindow }
+    return &SlidingWindow{
+        window: uint64(w),
+        state:  make(map[[K_SZ]byte]*nonceWindowState),
+    }
+}
+
+// Check reports whether msgNumber would be accepted for pk without
+// recording it as seen, so it is safe to call before authenticating the
+// message it belongs to.
+func (sw *SlidingWindow) Check(ctx context.Context, pk *[K_SZ]byte, msgNumber uint64) error {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+
+    st := sw.state[*pk]
+    if st == nil || !st.seen { return nil }
+
+    if msgNumber > st.highest { return nil }
+
+    diff := st.highest - msgNumber
+    if diff >= sw.window {
+        return errors.New("nonce too old: outside the replay window.")
+    }
+    if st.bitmap&(uint64(1)<<diff) != 0 {
+        return errors.New("nonce already seen: replay.")
+    }
+    return nil
+}
+
+// Update records msgNumber as accepted for pk, advancing the window if
+// msgNumber is a new high. Callers must only call Update once msgNumber's
+// message has been authenticated.
+func (sw *SlidingWindow) Update(ctx context.Context, pk *[K_SZ]byte, msgNumber uint64) error {
+    sw.mu.Lock()
+    defer sw.mu.Unlock()
+
+    st := sw.state[*pk]
+    if st == nil {
+        st = &nonceWindowState{}
+        sw.state[*pk] = st
+    }
+
+    if !st.seen {
+        st.seen = true
+        st.highest = msgNumber
+        st.bitmap = 1
+        return nil
+    }
+
+    if msgNumber > st.highest {
+        shift := msgNumber - st.highest
+        if shift >= sw.window {
+            st.bitmap = 1
+        } else {
+            st.bitmap = (st.bitmap << shift) | 1
+        }
+        st.highest = msgNumber
+        return nil
+    }
+
+    diff := st.highest - msgNumber
+    if diff >= sw.window {
+        return errors.New("nonce too old: outside the replay window.")
+    }
+    bit := uint64(1) << diff
+    if st.bitmap&bit != 0 {
+        return errors.New("nonce already seen: replay.")
+    }
+    st.bitmap |= bit
+    return nil
+}
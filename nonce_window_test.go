@@ -0,0 +1,100 @@
+package golesali
+
+import (
+    "testing"
+    "golang.org/x/net/context"
+)
+
+func acceptAndUpdate(t *testing.T, sw *SlidingWindow, pk *[K_SZ]byte, n uint64) {
+    if err := sw.Check(context.Background(), pk, n); err != nil {
+        t.Fatalf("expected nonce %d to be accepted, got: %v", n, err)
+    }
+    if err := sw.Update(context.Background(), pk, n); err != nil {
+        t.Fatalf("expected nonce %d to update cleanly, got: %v", n, err)
+    }
+}
+
+func TestSlidingWindowAcceptsIncreasing(t *testing.T) {
+    sw := NewSlidingWindow(128)
+    var pk [K_SZ]byte
+
+    for n := uint64(0); n < 10; n += 2 {
+        acceptAndUpdate(t, sw, &pk, n)
+    }
+}
+
+func TestSlidingWindowRejectsReplay(t *testing.T) {
+    sw := NewSlidingWindow(128)
+    var pk [K_SZ]byte
+
+    acceptAndUpdate(t, sw, &pk, 10)
+    acceptAndUpdate(t, sw, &pk, 12)
+
+    if err := sw.Check(context.Background(), &pk, 10); err == nil {
+        t.Fatal("expected replay of nonce 10 to be rejected")
+    }
+}
+
+func TestSlidingWindowRejectsOutOfWindow(t *testing.T) {
+    sw := NewSlidingWindow(8)
+    var pk [K_SZ]byte
+
+    acceptAndUpdate(t, sw, &pk, 100)
+
+    if err := sw.Check(context.Background(), &pk, 100-8); err == nil {
+        t.Fatal("expected a nonce at the window edge to be rejected")
+    }
+    if err := sw.Check(context.Background(), &pk, 100-7); err != nil {
+        t.Fatalf("expected a nonce just inside the window to be accepted, got: %v", err)
+    }
+}
+
+func TestSlidingWindowAcceptsOutOfOrderWithinWindow(t *testing.T) {
+    sw := NewSlidingWindow(128)
+    var pk [K_SZ]byte
+
+    acceptAndUpdate(t, sw, &pk, 20)
+    acceptAndUpdate(t, sw, &pk, 16)
+    acceptAndUpdate(t, sw, &pk, 18)
+
+    if err := sw.Check(context.Background(), &pk, 16); err == nil {
+        t.Fatal("expected replay of an out-of-order nonce to be rejected")
+    }
+}
+
+// TestSlidingWindowEvenOddSplit mirrors HandleRequest's use of the window:
+// a single SlidingWindow keyed by the client's public key only ever sees the
+// even request-side message numbers, since odd response numbers are never
+// passed through CheckNonceFunc/UpdateNonceFunc.
+func TestSlidingWindowEvenOddSplit(t *testing.T) {
+    sw := NewSlidingWindow(128)
+    var pk [K_SZ]byte
+
+    for n := uint64(0); n < 20; n += 2 {
+        acceptAndUpdate(t, sw, &pk, n)
+    }
+
+    if err := sw.Check(context.Background(), &pk, 18); err == nil {
+        t.Fatal("expected replay of an even request nonce to be rejected")
+    }
+
+    // an odd number in between two accepted even ones has never been seen,
+    // so it is neither a replay nor out of window -- it is simply not a
+    // value the request path would ever pass in, and the window must not
+    // mistake it for one.
+    if err := sw.Check(context.Background(), &pk, 17); err != nil {
+        t.Fatalf("expected never-seen odd nonce 17 to be accepted by Check, got: %v", err)
+    }
+}
+
+func TestSlidingWindowPerPublicKeyIsolation(t *testing.T) {
+    sw := NewSlidingWindow(128)
+    var pkA, pkB [K_SZ]byte
+    pkB[0] = 1
+
+    acceptAndUpdate(t, sw, &pkA, 50)
+
+    if err := sw.Check(context.Background(), &pkB, 50); err != nil {
+        t.Fatalf("expected nonce 50 for a different public key to be unaffected, got: %v", err)
+    }
+}
@@ -0,0 +1,138 @@
+package golesali
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/binary"
+    "errors"
+    "io"
+    "golang.org/x/crypto/argon2"
+    "golang.org/x/crypto/nacl/box"
+)
+
+// ## PASSWORD-DERIVED SHARED SECRETS ##
+//
+// EstablishContextFunc hands back an ss from a prior NaCl key exchange,
+// which CLI tools and one-off file encryption don't always have.
+// DeriveSharedSecret and Seal/OpenPasswordEnvelope bootstrap ss from a
+// passphrase via Argon2id instead, with the parameters travelling in the
+// envelope so a receiver needs no out-of-band coordination.
+
+// Argon2Params are the Argon2id tuning parameters carried in a password
+// envelope header. Time and Memory follow the argon2 package's units
+// (iterations, KiB).
+type Argon2Params struct {
+    Time    uint32
+    Memory  uint32
+    Threads uint8
+}
+
+// DefaultArgon2Params is a reasonable interactive-use default: 64 MiB of
+// memory, 3 passes, single-threaded.
+var DefaultArgon2Params = Argon2Params{Time: 3, Memory: 64 * 1024, Threads: 1}
+
+// MinArgon2Params is the floor SealPasswordEnvelope and OpenPasswordEnvelope
+// enforce (DeriveSharedSecret itself does not check it); envelopes whose header advertises weaker parameters are refused
+// rather than silently honoured, so a sender (or attacker) can't downgrade
+// a receiver's work factor.
+var MinArgon2Params = Argon2Params{Time: 1, Memory: 16 * 1024, Threads: 1}
+
+func (p Argon2Params) weakerThan(min Argon2Params) bool {
+    return p.Time < min.Time || p.Memory < min.Memory || p.Threads < min.Threads
+}
+
+// DeriveSharedSecret derives a K_SZ-byte shared secret from password and
+// salt using Argon2id.
+func DeriveSharedSecret(password []byte, salt []byte, params Argon2Params) *[K_SZ]byte {
+    var ss [K_SZ]byte
+    key := argon2.IDKey(password, salt, params.Time, params.Memory, params.Threads, K_SZ)
+    copy(ss[:], key)
+    return &ss
+}
+
+const passwordHeaderVersion = 1
+
+// passwordHeaderFixedLen (the header without salt) is
+// [version u8][time u32][memory u32][par u8][saltLen u8].
+const passwordHeaderFixedLen = 1 + 4 + 4 + 1 + 1
+
+func marshalPasswordHeader(params Argon2Params, salt []byte) ([]byte, error) {
+    if len(salt) > 255 { return nil, errors.New("salt too long.") }
+
+    header := make([]byte, passwordHeaderFixedLen+len(salt))
+    header[0] = passwordHeaderVersion
+    binary.BigEndian.PutUint32(header[1:5], params.Time)
+    binary.BigEndian.PutUint32(header[5:9], params.Memory)
+    header[9] = params.Threads
+    header[10] = byte(len(salt))
+    copy(header[passwordHeaderFixedLen:], salt)
+    return header, nil
+}
+
+func unmarshalPasswordHeader(r io.Reader) (Argon2Params, []byte, error) {
+    var fixed [passwordHeaderFixedLen]byte
+    if _, err := io.ReadFull(r, fixed[:]); err != nil { return Argon2Params{}, nil, err }
+
+    if fixed[0] != passwordHeaderVersion {
+        return Argon2Params{}, nil, errors.New("unsupported password envelope version.")
+    }
+
+    params := Argon2Params{
+        Time:    binary.BigEndian.Uint32(fixed[1:5]),
+        Memory:  binary.BigEndian.Uint32(fixed[5:9]),
+        Threads: fixed[9],
+    }
+    saltLen := int(fixed[10])
+
+    salt := make([]byte, saltLen)
+    if _, err := io.ReadFull(r, salt); err != nil { return Argon2Params{}, nil, err }
+
+    return params, salt, nil
+}
+
+// SealPasswordEnvelope derives ss from password via Argon2id with params
+// (generating a random salt if salt is nil), prepends the header described
+// above, and seals plain as a stripped envelope under the derived ss.
+func SealPasswordEnvelope(sealed io.Writer, plain io.Reader, password []byte,
+salt []byte, params Argon2Params, padding byte, msgNumber uint64) error {
+    if params.weakerThan(MinArgon2Params) {
+        return errors.New("Argon2 parameters are weaker than MinArgon2Params.")
+    }
+
+    if salt == nil {
+        salt = make([]byte, K_SZ)
+        if _, err := rand.Read(salt); err != nil { return err }
+    }
+
+    header, err := marshalPasswordHeader(params, salt)
+    if err != nil { return err }
+    if _, err := sealed.Write(header); err != nil { return err }
+
+    ss := DeriveSharedSecret(password, salt, params)
+    return SealStrippedEnvelope(sealed, plain, ss, padding, msgNumber)
+}
+
+// OpenPasswordEnvelope reads the Argon2 header sealed carries, refuses it if
+// its parameters are weaker than MinArgon2Params, rederives ss from
+// password, and opens the remaining stripped envelope.
+func OpenPasswordEnvelope(sealed io.Reader, password []byte, msgNumber uint64) ([]byte, error) {
+    params, salt, err := unmarshalPasswordHeader(sealed)
+    if err != nil { return nil, err }
+
+    if params.weakerThan(MinArgon2Params) {
+        return nil, errors.New("Argon2 parameters are weaker than MinArgon2Params.")
+    }
+
+    ss := DeriveSharedSecret(password, salt, params)
+
+    var cipherBuf bytes.Buffer
+    if _, err := io.Copy(&cipherBuf, sealed); err != nil { return nil, err }
+
+    var nonce [N_SZ]byte
+    binary.BigEndian.PutUint64(nonce[N_SZ-8:], msgNumber)
+
+    padded, success := box.OpenAfterPrecomputation(nil, cipherBuf.Bytes(), &nonce, ss)
+    if !success { return nil, errors.New("Authentication error.") }
+
+    return StripPadding(padded)
+}
@@ -0,0 +1,43 @@
+package golesali
+
+import (
+    "bytes"
+    "testing"
+)
+
+func TestPasswordEnvelopeRoundTrip(t *testing.T) {
+    password := []byte("correct horse battery staple")
+    plain := "password envelope round trip"
+
+    var sealed bytes.Buffer
+    err := SealPasswordEnvelope(&sealed, bytes.NewReader([]byte(plain)), password,
+        nil, DefaultArgon2Params, 1, 7)
+    if err != nil { t.Fatalf("SealPasswordEnvelope: %v", err) }
+
+    opened, err := OpenPasswordEnvelope(&sealed, password, 7)
+    if err != nil { t.Fatalf("OpenPasswordEnvelope: %v", err) }
+
+    if string(opened) != plain {
+        t.Fatalf("got %q, want %q", opened, plain)
+    }
+}
+
+func TestPasswordEnvelopeWrongPasswordFailsAuthentication(t *testing.T) {
+    var sealed bytes.Buffer
+    err := SealPasswordEnvelope(&sealed, bytes.NewReader([]byte("secret")),
+        []byte("right password"), nil, DefaultArgon2Params, 1, 1)
+    if err != nil { t.Fatalf("SealPasswordEnvelope: %v", err) }
+
+    if _, err := OpenPasswordEnvelope(&sealed, []byte("wrong password"), 1); err == nil {
+        t.Fatal("expected a wrong password to fail authentication")
+    }
+}
+
+func TestPasswordEnvelopeRejectsWeakParams(t *testing.T) {
+    var sealed bytes.Buffer
+    weak := Argon2Params{Time: 1, Memory: 1, Threads: 1}
+    if err := SealPasswordEnvelope(&sealed, bytes.NewReader([]byte("secret")),
+        []byte("password"), nil, weak, 1, 1); err == nil {
+        t.Fatal("expected parameters weaker than MinArgon2Params to be rejected")
+    }
+}
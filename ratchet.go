@@ -0,0 +1,438 @@
+package golesali
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "io"
+    "golang.org/x/crypto/curve25519"
+    "golang.org/x/crypto/nacl/box"
+    "golang.org/x/crypto/nacl/secretbox"
+    "golang.org/x/net/context"
+)
+
+// ## DOUBLE RATCHET ##
+//
+// RatchetContext replaces the flat, long-lived ss used by
+// ClientServerDispatcher with state that evolves on every direction change,
+// so compromising it at time T doesn't expose messages sent before T. A DH
+// ratchet step runs whenever the sending side changes; message headers
+// (sender's ratchet pubkey, counter, replaced chain length) are themselves
+// sealed under a header key precomputed one step ahead, Signal-style, so a
+// receiver can open a header for a brand-new chain.
+
+// labels distinguish the values derived from one HKDF-style update; each
+// must be distinct or root/chain/header keys would collide.
+const (
+    ratchetRootLabel        = "golesali-ratchet-root"
+    ratchetChainLabel       = "golesali-ratchet-chain"
+    ratchetNextHeaderLabel  = "golesali-ratchet-next-header"
+    ratchetInitHeaderLabel  = "golesali-ratchet-initial-header"
+    ratchetMsgLabel         = "msg"
+    ratchetStepLabel        = "step"
+)
+
+// MAX_SKIPPED_KEYS bounds the number of out-of-order message keys cached per
+// RatchetContext, so a withholding peer can't force unbounded memory growth.
+const MAX_SKIPPED_KEYS = 1000
+
+// ratchetHeader is the unencrypted per-message header: sender's current
+// ratchet pubkey, its counter in the current chain, and the length of the
+// chain it replaced.
+type ratchetHeader struct {
+    pub          [K_SZ]byte
+    counter      uint64
+    prevChainLen uint64
+}
+
+const ratchetHeaderLen = K_SZ + 8 + 8
+
+func (h *ratchetHeader) marshal() []byte {
+    buf := make([]byte, ratchetHeaderLen)
+    copy(buf[0:K_SZ], h.pub[:])
+    binary.BigEndian.PutUint64(buf[K_SZ:K_SZ+8], h.counter)
+    binary.BigEndian.PutUint64(buf[K_SZ+8:K_SZ+16], h.prevChainLen)
+    return buf
+}
+
+func unmarshalRatchetHeader(buf []byte) (*ratchetHeader, error) {
+    if len(buf) != ratchetHeaderLen { return nil, errors.New("malformed ratchet header.") }
+    h := &ratchetHeader{}
+    copy(h.pub[:], buf[0:K_SZ])
+    h.counter = binary.BigEndian.Uint64(buf[K_SZ : K_SZ+8])
+    h.prevChainLen = binary.BigEndian.Uint64(buf[K_SZ+8 : K_SZ+16])
+    return h, nil
+}
+
+type skippedKey struct {
+    pub     [K_SZ]byte
+    counter uint64
+}
+
+// RatchetContext holds one side's view of a ratcheting session. Not safe
+// for concurrent use.
+type RatchetContext struct {
+    rootKey [K_SZ]byte
+
+    myPriv [K_SZ]byte
+    myPub  [K_SZ]byte
+
+    theirPub [K_SZ]byte
+
+    sendHeaderKey     [K_SZ]byte
+    sendNextHeaderKey [K_SZ]byte
+    recvHeaderKey     [K_SZ]byte
+    recvNextHeaderKey [K_SZ]byte
+
+    sendChainKey [K_SZ]byte
+    recvChainKey [K_SZ]byte
+
+    sendCount        uint64
+    recvCount        uint64
+    sendPrevChainLen uint64
+
+    // set once this side learns of a new chain from the peer, cleared the
+    // next time it sends: the receiving side ratchets before replying.
+    needsSendRatchet bool
+
+    skipped map[skippedKey][K_SZ]byte
+
+    // recvHeaderKey of a chain rotated away from, keyed by its sender
+    // pubkey, kept as long as skipped still holds a key from it -- a late
+    // message from further back than recvNextHeaderKey covers needs this to
+    // open its header at all.
+    skippedHeaderKeys map[[K_SZ]byte][K_SZ]byte
+}
+
+// NewRatchetContextInitiator and NewRatchetContextResponder start a session
+// from a shared root key and the ratchet keypairs exchanged to establish it.
+// The two sides are NOT interchangeable: the initiator gets a usable
+// sending chain immediately, while the responder must ratchet -- generate a
+// fresh keypair -- before it can send, since ScalarMult(aPriv,bPub) ==
+// ScalarMult(bPriv,aPub) would otherwise give both sides the same initial
+// sending key and nonce.
+func NewRatchetContextInitiator(rootKey *[K_SZ]byte, myInitialPriv *[K_SZ]byte,
+myInitialPub *[K_SZ]byte, theirInitialPub *[K_SZ]byte) (*RatchetContext, error) {
+    rc, chain0, nhk1, err := newRatchetContextCommon(rootKey, myInitialPriv, myInitialPub, theirInitialPub)
+    if err != nil { return nil, err }
+
+    rc.sendHeaderKey = hmacLabel(rootKey[:], ratchetInitHeaderLabel)
+    rc.sendChainKey = chain0
+    rc.sendNextHeaderKey = nhk1
+    // no receiving chain yet; recvNextHeaderKey is precomputed to open the
+    // responder's first (ratcheted) reply.
+    rc.recvNextHeaderKey = nhk1
+    rc.needsSendRatchet = false
+    return rc, nil
+}
+
+func NewRatchetContextResponder(rootKey *[K_SZ]byte, myInitialPriv *[K_SZ]byte,
+myInitialPub *[K_SZ]byte, theirInitialPub *[K_SZ]byte) (*RatchetContext, error) {
+    rc, chain0, nhk1, err := newRatchetContextCommon(rootKey, myInitialPriv, myInitialPub, theirInitialPub)
+    if err != nil { return nil, err }
+
+    rc.recvHeaderKey = hmacLabel(rootKey[:], ratchetInitHeaderLabel)
+    rc.recvChainKey = chain0
+    rc.recvNextHeaderKey = nhk1
+    // no sending chain yet; forces a real ratchet before the first send.
+    rc.sendNextHeaderKey = nhk1
+    rc.needsSendRatchet = true
+    return rc, nil
+}
+
+// newRatchetContextCommon derives the values both constructors need; chain0
+// and nhk1 come out identical on both sides since they derive from the same
+// DH output.
+func newRatchetContextCommon(rootKey *[K_SZ]byte, myInitialPriv *[K_SZ]byte,
+myInitialPub *[K_SZ]byte, theirInitialPub *[K_SZ]byte) (rc *RatchetContext, chain0 [K_SZ]byte, nhk1 [K_SZ]byte, err error) {
+    rc = &RatchetContext{
+        skipped:           make(map[skippedKey][K_SZ]byte),
+        skippedHeaderKeys: make(map[[K_SZ]byte][K_SZ]byte),
+    }
+    rc.myPriv = *myInitialPriv
+    rc.myPub = *myInitialPub
+    rc.theirPub = *theirInitialPub
+
+    var shared [K_SZ]byte
+    curve25519.ScalarMult(&shared, &rc.myPriv, &rc.theirPub)
+    newRoot, chainKey, nextHeaderKey := ratchetKDF(rootKey, &shared)
+
+    rc.rootKey = newRoot
+    return rc, chainKey, nextHeaderKey, nil
+}
+
+// ratchetKDF hashes the label, root key and new DH output into an HMAC key,
+// then derives the new root, chain and next-header keys from it by label.
+func ratchetKDF(rootKey *[K_SZ]byte, dhOut *[K_SZ]byte) (newRoot, chainKey, nextHeaderKey [K_SZ]byte) {
+    h := sha256.New()
+    h.Write([]byte(ratchetRootLabel))
+    h.Write(rootKey[:])
+    h.Write(dhOut[:])
+    hmacKey := h.Sum(nil)
+
+    newRoot = hmacLabel(hmacKey, ratchetRootLabel)
+    chainKey = hmacLabel(hmacKey, ratchetChainLabel)
+    nextHeaderKey = hmacLabel(hmacKey, ratchetNextHeaderLabel)
+    return
+}
+
+func hmacLabel(key []byte, label string) [K_SZ]byte {
+    var out [K_SZ]byte
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(label))
+    copy(out[:], mac.Sum(nil))
+    return out
+}
+
+// chainStep derives the current message key and the chain key that
+// replaces it, giving each message forward secrecy within the chain.
+func chainStep(chainKey *[K_SZ]byte) (msgKey, nextChainKey [K_SZ]byte) {
+    msgKey = hmacLabel(chainKey[:], ratchetMsgLabel)
+    nextChainKey = hmacLabel(chainKey[:], ratchetStepLabel)
+    return
+}
+
+func ratchetNonce(counter uint64) [N_SZ]byte {
+    var nonce [N_SZ]byte
+    binary.BigEndian.PutUint64(nonce[N_SZ-8:], counter)
+    return nonce
+}
+
+// sendRatchet rotates this side's ratchet keypair and DHs it against the
+// peer's pubkey, establishing a fresh sending chain. Runs lazily on the
+// first SealRatchetEnvelope call after a new chain was learned.
+func (rc *RatchetContext) sendRatchet() error {
+    pub, priv, err := box.GenerateKey(rand.Reader)
+    if err != nil { return err }
+
+    var shared [K_SZ]byte
+    curve25519.ScalarMult(&shared, priv, &rc.theirPub)
+    newRoot, chainKey, nextHeaderKey := ratchetKDF(&rc.rootKey, &shared)
+
+    rc.rootKey = newRoot
+    rc.myPriv = *priv
+    rc.myPub = *pub
+    rc.sendHeaderKey = rc.sendNextHeaderKey
+    rc.sendNextHeaderKey = nextHeaderKey
+    rc.sendChainKey = chainKey
+    rc.sendPrevChainLen = rc.sendCount
+    rc.sendCount = 0
+    rc.needsSendRatchet = false
+    return nil
+}
+
+// recvRatchet mirrors sendRatchet: run once a header only opens under
+// recvNextHeaderKey, meaning the peer started a new chain.
+func (rc *RatchetContext) recvRatchet(theirNewPub *[K_SZ]byte) error {
+    var shared [K_SZ]byte
+    curve25519.ScalarMult(&shared, &rc.myPriv, theirNewPub)
+    newRoot, chainKey, nextHeaderKey := ratchetKDF(&rc.rootKey, &shared)
+
+    rc.rootKey = newRoot
+    rc.recvHeaderKey = rc.recvNextHeaderKey
+    rc.recvNextHeaderKey = nextHeaderKey
+    rc.recvChainKey = chainKey
+    rc.theirPub = *theirNewPub
+    rc.recvCount = 0
+    rc.needsSendRatchet = true
+    return nil
+}
+
+// SealRatchetEnvelope seals plain under rc's current sending chain,
+// ratcheting first if needed, then writes the sealed header followed by the
+// sealed payload. Advances rc for the next call.
+func SealRatchetEnvelope(sealed io.Writer, plain io.Reader, rc *RatchetContext,
+padding byte) error {
+    if padding < 1 { return errors.New("padding must be at lest 1.") }
+
+    if rc.needsSendRatchet {
+        if err := rc.sendRatchet(); err != nil { return err }
+    }
+
+    header := ratchetHeader{pub: rc.myPub, counter: rc.sendCount, prevChainLen: rc.sendPrevChainLen}
+    var headerNonce [N_SZ]byte
+    if _, err := rand.Read(headerNonce[:]); err != nil { return err }
+    sealedHeader := secretbox.Seal(nil, header.marshal(), &headerNonce, &rc.sendHeaderKey)
+    sealed.Write(headerNonce[:])
+    sealed.Write(sealedHeader)
+
+    var plainBuf bytes.Buffer
+    if _, err := io.Copy(&plainBuf, plain); err != nil { return err }
+    paddingBuf := make([]byte, padding)
+    for i := 0; i < int(padding); i++ { paddingBuf[i] = padding }
+    plainBuf.Write(paddingBuf)
+
+    msgKey, nextChainKey := chainStep(&rc.sendChainKey)
+    rc.sendChainKey = nextChainKey
+    nonce := ratchetNonce(rc.sendCount)
+    cipher := secretbox.Seal(nil, plainBuf.Bytes(), &nonce, &msgKey)
+    sealed.Write(cipher)
+
+    rc.sendCount++
+    return nil
+}
+
+// OpenRatchetEnvelope reverses SealRatchetEnvelope, ratcheting the receive
+// side when the header only opens under recvNextHeaderKey. A header that
+// only opens under a cached skippedHeaderKeys entry belongs to a replaced
+// chain: no ratchet runs, and its message key comes from the skipped cache.
+func OpenRatchetEnvelope(sealed io.Reader, plain io.Writer, rc *RatchetContext) error {
+    var headerNonce [N_SZ]byte
+    if _, err := io.ReadFull(sealed, headerNonce[:]); err != nil { return err }
+
+    sealedHeader := make([]byte, ratchetHeaderLen+secretbox.Overhead)
+    if _, err := io.ReadFull(sealed, sealedHeader); err != nil { return err }
+
+    headerBytes, success := secretbox.Open(nil, sealedHeader, &headerNonce, &rc.recvHeaderKey)
+    newChain := false
+    if !success {
+        headerBytes, success = secretbox.Open(nil, sealedHeader, &headerNonce, &rc.recvNextHeaderKey)
+        if success {
+            newChain = true
+        } else {
+            for _, hk := range rc.skippedHeaderKeys {
+                hk := hk
+                if hb, ok := secretbox.Open(nil, sealedHeader, &headerNonce, &hk); ok {
+                    headerBytes, success = hb, true
+                    break
+                }
+            }
+        }
+        if !success { return errors.New("Authentication error.") }
+    }
+    header, err := unmarshalRatchetHeader(headerBytes)
+    if err != nil { return err }
+
+    if newChain {
+        if err := rc.exhaustChain(header.prevChainLen); err != nil { return err }
+        if err := rc.recvRatchet(&header.pub); err != nil { return err }
+    }
+
+    var cipher bytes.Buffer
+    if _, err := io.Copy(&cipher, sealed); err != nil { return err }
+
+    msgKey, err := rc.messageKey(header)
+    if err != nil { return err }
+
+    nonce := ratchetNonce(header.counter)
+    msg, success := secretbox.Open(nil, cipher.Bytes(), &nonce, &msgKey)
+    if !success { return errors.New("Authentication error.") }
+
+    stripped, err := StripPadding(msg)
+    if err != nil { return err }
+    _, err = plain.Write(stripped)
+    return err
+}
+
+// exhaustChain caches message keys for any unseen messages of the chain
+// about to be replaced, up to the length the sender says it reached, and
+// stashes its recvHeaderKey if it caches anything, since recvRatchet is
+// about to overwrite it.
+func (rc *RatchetContext) exhaustChain(prevChainLen uint64) error {
+    if rc.recvCount < prevChainLen {
+        rc.skippedHeaderKeys[rc.theirPub] = rc.recvHeaderKey
+    }
+    for rc.recvCount < prevChainLen {
+        if len(rc.skipped) >= MAX_SKIPPED_KEYS {
+            return errors.New("too many skipped messages.")
+        }
+        msgKey, nextChainKey := chainStep(&rc.recvChainKey)
+        rc.skipped[skippedKey{pub: rc.theirPub, counter: rc.recvCount}] = msgKey
+        rc.recvChainKey = nextChainKey
+        rc.recvCount++
+    }
+    return nil
+}
+
+// forgetSkipped drops a consumed skipped-message key, and its chain's
+// header key once no skipped entries for that chain remain.
+func (rc *RatchetContext) forgetSkipped(k skippedKey) {
+    delete(rc.skipped, k)
+    for other := range rc.skipped {
+        if other.pub == k.pub { return }
+    }
+    delete(rc.skippedHeaderKeys, k.pub)
+}
+
+// messageKey returns the key for header, advancing rc.recvChainKey and
+// caching any skipped along the way, or pulling a cached key for an
+// out-of-order message. rc.recvCount only tracks the current chain, so a
+// message from a replaced chain (header.pub != rc.theirPub) is looked up by
+// pub+counter directly: its counter could otherwise coincide with the
+// current chain's count and hide a cached key.
+func (rc *RatchetContext) messageKey(header *ratchetHeader) ([K_SZ]byte, error) {
+    if !bytes.Equal(header.pub[:], rc.theirPub[:]) {
+        k := skippedKey{pub: header.pub, counter: header.counter}
+        key, ok := rc.skipped[k]
+        if !ok { return key, errors.New("message key not available (replay or too old).") }
+        rc.forgetSkipped(k)
+        return key, nil
+    }
+
+    if header.counter < rc.recvCount {
+        k := skippedKey{pub: header.pub, counter: header.counter}
+        key, ok := rc.skipped[k]
+        if !ok { return key, errors.New("message key not available (replay or too old).") }
+        rc.forgetSkipped(k)
+        return key, nil
+    }
+
+    for rc.recvCount < header.counter {
+        if len(rc.skipped) >= MAX_SKIPPED_KEYS {
+            return [K_SZ]byte{}, errors.New("too many skipped messages.")
+        }
+        skippedMsgKey, nextChainKey := chainStep(&rc.recvChainKey)
+        rc.skipped[skippedKey{pub: header.pub, counter: rc.recvCount}] = skippedMsgKey
+        rc.recvChainKey = nextChainKey
+        rc.recvCount++
+    }
+
+    msgKey, nextChainKey := chainStep(&rc.recvChainKey)
+    rc.recvChainKey = nextChainKey
+    rc.recvCount++
+    return msgKey, nil
+}
+
+// ## RATCHETING CLIENT/SERVER COMMUNICATION ##
+
+type RatchetEstablishFunc func(ctx context.Context, pk *[K_SZ]byte,
+msgNumber uint64) (context.Context, *RatchetContext, error)
+
+// RatchetDispatcher is the forward-secret counterpart to
+// ClientServerDispatcher: EstablishContext hands back a RatchetContext
+// instead of a flat ss.
+type RatchetDispatcher struct {
+    EstablishContext RatchetEstablishFunc
+    UpdateNonce      UpdateNonceFunc
+    RequestHandler   RequestHandlerFunc
+    GetPaddingSize   PaddingSizeFunc
+}
+
+func (rd *RatchetDispatcher) HandleRequest(ctx context.Context,
+responseWriter io.Writer, requestReader io.Reader) error {
+    var pk [K_SZ]byte
+
+    // static public key used to look up the session; everything else
+    // needed to decrypt travels inside the ratchet envelope itself.
+    if _, err := requestReader.Read(pk[:]); err != nil { return err }
+
+    newCtx, rc, err := rd.EstablishContext(ctx, &pk, 0)
+    if err != nil { return err }
+
+    var requestBuffer bytes.Buffer
+    if err := OpenRatchetEnvelope(requestReader, &requestBuffer, rc); err != nil { return err }
+
+    if err := rd.UpdateNonce(newCtx, &pk, rc.recvCount); err != nil { return err }
+
+    var plainResponseBuffer bytes.Buffer
+    if err := rd.RequestHandler(newCtx, &requestBuffer, &plainResponseBuffer); err != nil { return err }
+
+    getPaddingSize := rd.GetPaddingSize
+    if getPaddingSize == nil { getPaddingSize = DefaultPaddingSize }
+    _, padding := getPaddingSize(plainResponseBuffer.Len())
+
+    return SealRatchetEnvelope(responseWriter, &plainResponseBuffer, rc, padding)
+}
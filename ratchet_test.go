@@ -0,0 +1,163 @@
+package golesali
+
+import (
+    "bytes"
+    "crypto/rand"
+    "golang.org/x/crypto/nacl/box"
+    "testing"
+)
+
+func newRatchetPair(t *testing.T) (*RatchetContext, *RatchetContext) {
+    var rootKey [K_SZ]byte
+    if _, err := rand.Read(rootKey[:]); err != nil { t.Fatalf("rootKey: %v", err) }
+
+    initiatorPub, initiatorPriv, err := box.GenerateKey(rand.Reader)
+    if err != nil { t.Fatalf("initiator keypair: %v", err) }
+    responderPub, responderPriv, err := box.GenerateKey(rand.Reader)
+    if err != nil { t.Fatalf("responder keypair: %v", err) }
+
+    initiator, err := NewRatchetContextInitiator(&rootKey, initiatorPriv, initiatorPub, responderPub)
+    if err != nil { t.Fatalf("NewRatchetContextInitiator: %v", err) }
+    responder, err := NewRatchetContextResponder(&rootKey, responderPriv, responderPub, initiatorPub)
+    if err != nil { t.Fatalf("NewRatchetContextResponder: %v", err) }
+
+    return initiator, responder
+}
+
+func sealRatchet(t *testing.T, sender *RatchetContext, plain string) []byte {
+    var sealed bytes.Buffer
+    if err := SealRatchetEnvelope(&sealed, bytes.NewReader([]byte(plain)), sender, 1); err != nil {
+        t.Fatalf("SealRatchetEnvelope: %v", err)
+    }
+    return sealed.Bytes()
+}
+
+func openRatchet(receiver *RatchetContext, sealed []byte) (string, error) {
+    var opened bytes.Buffer
+    err := OpenRatchetEnvelope(bytes.NewReader(sealed), &opened, receiver)
+    return opened.String(), err
+}
+
+func sealOpenRatchet(t *testing.T, sender, receiver *RatchetContext, plain string) string {
+    sealed := sealRatchet(t, sender, plain)
+    got, err := openRatchet(receiver, sealed)
+    if err != nil { t.Fatalf("OpenRatchetEnvelope: %v", err) }
+    return got
+}
+
+func TestRatchetRoundTrip(t *testing.T) {
+    initiator, responder := newRatchetPair(t)
+
+    if got := sealOpenRatchet(t, initiator, responder, "hello from initiator"); got != "hello from initiator" {
+        t.Fatalf("got %q", got)
+    }
+
+    if got := sealOpenRatchet(t, responder, initiator, "hello from responder"); got != "hello from responder" {
+        t.Fatalf("got %q", got)
+    }
+}
+
+// TestRatchetStepsOnFirstReply confirms the responder actually performs a DH
+// ratchet before its first send, rather than reusing the mutual chain both
+// sides can derive from the initial keys alone.
+func TestRatchetStepsOnFirstReply(t *testing.T) {
+    initiator, responder := newRatchetPair(t)
+    initialResponderPub := responder.myPub
+
+    sealOpenRatchet(t, initiator, responder, "first message")
+    sealOpenRatchet(t, responder, initiator, "reply")
+
+    if bytes.Equal(responder.myPub[:], initialResponderPub[:]) {
+        t.Fatal("expected responder to ratchet to a new keypair before its first send")
+    }
+    if bytes.Equal(initiator.theirPub[:], initialResponderPub[:]) {
+        t.Fatal("expected initiator to learn the responder's ratcheted pubkey")
+    }
+}
+
+func TestRatchetMultipleRoundsAdvanceRootKey(t *testing.T) {
+    initiator, responder := newRatchetPair(t)
+    initialRoot := initiator.rootKey
+
+    for i := 0; i < 5; i++ {
+        sealOpenRatchet(t, initiator, responder, "ping")
+        sealOpenRatchet(t, responder, initiator, "pong")
+    }
+
+    if bytes.Equal(initiator.rootKey[:], initialRoot[:]) {
+        t.Fatal("expected rootKey to advance across repeated ratchet steps")
+    }
+    if !bytes.Equal(initiator.rootKey[:], responder.rootKey[:]) {
+        t.Fatal("expected both sides to converge on the same rootKey")
+    }
+}
+
+// TestRatchetSkippedWithinChain delivers a chain's messages out of order and
+// confirms the one delivered late is still decryptable via messageKey's
+// skipped-key cache.
+func TestRatchetSkippedWithinChain(t *testing.T) {
+    initiator, responder := newRatchetPair(t)
+
+    a0 := sealRatchet(t, initiator, "A0")
+    a1 := sealRatchet(t, initiator, "A1")
+    a2 := sealRatchet(t, initiator, "A2")
+
+    if got, err := openRatchet(responder, a0); err != nil || got != "A0" {
+        t.Fatalf("a0: got %q, err %v", got, err)
+    }
+    if got, err := openRatchet(responder, a2); err != nil || got != "A2" {
+        t.Fatalf("a2: got %q, err %v", got, err)
+    }
+    if got, err := openRatchet(responder, a1); err != nil || got != "A1" {
+        t.Fatalf("late a1: got %q, err %v", got, err)
+    }
+}
+
+// TestRatchetSkippedAcrossChainRotation withholds a message, lets the peer
+// rotate to a new sending chain in the meantime, and then delivers the
+// withheld message late: it exercises exhaustChain's caching and the
+// skippedHeaderKeys lookup that lets a header from an already-replaced chain
+// still be opened.
+func TestRatchetSkippedAcrossChainRotation(t *testing.T) {
+    initiator, responder := newRatchetPair(t)
+
+    a0 := sealRatchet(t, initiator, "A0")
+    a1 := sealRatchet(t, initiator, "A1")
+    a2 := sealRatchet(t, initiator, "A2") // withheld until after rotation
+
+    if got, err := openRatchet(responder, a0); err != nil || got != "A0" {
+        t.Fatalf("a0: got %q, err %v", got, err)
+    }
+    if got, err := openRatchet(responder, a1); err != nil || got != "A1" {
+        t.Fatalf("a1: got %q, err %v", got, err)
+    }
+
+    // responder's reply forces the initiator to ratchet before its next send
+    if got := sealOpenRatchet(t, responder, initiator, "B0"); got != "B0" {
+        t.Fatalf("b0: got %q", got)
+    }
+
+    a3 := sealRatchet(t, initiator, "A3") // new chain, prevChainLen == 3
+    if got, err := openRatchet(responder, a3); err != nil || got != "A3" {
+        t.Fatalf("a3: got %q, err %v", got, err)
+    }
+
+    if got, err := openRatchet(responder, a2); err != nil || got != "A2" {
+        t.Fatalf("late a2 across rotation: got %q, err %v", got, err)
+    }
+}
+
+// TestRatchetTooManySkippedKeys confirms messageKey refuses to cache past
+// MAX_SKIPPED_KEYS rather than growing the skipped map without bound.
+func TestRatchetTooManySkippedKeys(t *testing.T) {
+    initiator, responder := newRatchetPair(t)
+
+    var last []byte
+    for i := 0; i <= MAX_SKIPPED_KEYS+1; i++ {
+        last = sealRatchet(t, initiator, "msg")
+    }
+
+    if _, err := openRatchet(responder, last); err == nil {
+        t.Fatal("expected opening a message after more than MAX_SKIPPED_KEYS prior gaps to fail")
+    }
+}
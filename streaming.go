@@ -0,0 +1,126 @@
+package golesali
+
+import (
+    "encoding/binary"
+    "errors"
+    "io"
+    "golang.org/x/crypto/nacl/box"
+)
+
+// ## STREAMING ENVELOPE ##
+//
+// SealStrippedEnvelope buffers the whole plaintext and seals it in one
+// box.SealAfterPrecomputation call, which doesn't scale to multi-GB
+// payloads. The streaming envelope instead follows SSH's binary packet
+// protocol: fixed-size frames, each sealed and framed independently, so
+// sender and receiver both work a chunk at a time.
+
+// DefaultChunkSize is used by SealStreamingEnvelope when chunkSize <= 0.
+const DefaultChunkSize = 16 * 1024
+
+// frameLenSize is the width of the big-endian length prefix in front of
+// every sealed frame.
+const frameLenSize = 4
+
+// each frame's nonce carries the message-level msgNumber in its first 8
+// bytes and a monotonically increasing frame counter in the next 8, two
+// non-overlapping fields so no nonce is ever reused within a message.
+const streamFrameCounterSize = 8
+
+func streamFrameNonce(msgNumber uint64, frame uint64) [N_SZ]byte {
+    var nonce [N_SZ]byte
+    binary.BigEndian.PutUint64(nonce[0:8], msgNumber)
+    binary.BigEndian.PutUint64(nonce[8:8+streamFrameCounterSize], frame)
+    return nonce
+}
+
+// maxStreamCipherLen bounds the ciphertext length OpenStreamingEnvelope will
+// allocate for a single frame, so a malicious length prefix can't force a
+// multi-gigabyte allocation.
+func maxStreamCipherLen(chunkSize int) int {
+    if chunkSize <= 0 { chunkSize = DefaultChunkSize }
+    return 2*chunkSize + box.Overhead
+}
+
+// SealStreamingEnvelope seals plain as a sequence of sealed frames of at
+// most chunkSize plaintext bytes each (chunkSize <= 0 selects
+// DefaultChunkSize), per-frame padded like a stripped envelope, followed by
+// a final frame that seals zero bytes with no padding applied so the
+// receiver can tell it apart from a padded empty data frame and detect
+// truncation.
+func SealStreamingEnvelope(sealed io.Writer, plain io.Reader, ss *[K_SZ]byte,
+msgNumber uint64, chunkSize int) error {
+    if chunkSize <= 0 { chunkSize = DefaultChunkSize }
+
+    buf := make([]byte, chunkSize)
+    var frame uint64
+    for {
+        n, readErr := io.ReadFull(plain, buf)
+        if n > 0 {
+            if err := writeStreamFrame(sealed, buf[:n], ss, msgNumber, frame, true); err != nil { return err }
+            frame++
+        }
+        if readErr == io.EOF || readErr == io.ErrUnexpectedEOF { break }
+        if readErr != nil { return readErr }
+    }
+
+    return writeStreamFrame(sealed, nil, ss, msgNumber, frame, false)
+}
+
+func writeStreamFrame(sealed io.Writer, plain []byte, ss *[K_SZ]byte,
+msgNumber uint64, frame uint64, pad bool) error {
+    sealedPlain := plain
+    if pad {
+        _, padding := DefaultPaddingSize(len(plain))
+        sealedPlain = make([]byte, len(plain), len(plain)+int(padding))
+        copy(sealedPlain, plain)
+        for i := 0; i < int(padding); i++ { sealedPlain = append(sealedPlain, padding) }
+    }
+
+    nonce := streamFrameNonce(msgNumber, frame)
+    cipher := box.SealAfterPrecomputation(nil, sealedPlain, &nonce, ss)
+
+    var lenBuf [frameLenSize]byte
+    binary.BigEndian.PutUint32(lenBuf[:], uint32(len(cipher)))
+    if _, err := sealed.Write(lenBuf[:]); err != nil { return err }
+    _, err := sealed.Write(cipher)
+    return err
+}
+
+// OpenStreamingEnvelope reverses SealStreamingEnvelope, writing decrypted
+// frames to plain as they arrive and stopping at the unpadded zero-length
+// EOF frame. Reaching end-of-input before that frame is a truncation error,
+// not a clean end of stream. chunkSize must match the chunkSize the sender
+// used (chunkSize <= 0 selects DefaultChunkSize) so an oversized length
+// prefix can be rejected before it is used to allocate.
+func OpenStreamingEnvelope(sealed io.Reader, plain io.Writer, ss *[K_SZ]byte,
+msgNumber uint64, chunkSize int) error {
+    maxCipherLen := maxStreamCipherLen(chunkSize)
+
+    var frame uint64
+    for {
+        var lenBuf [frameLenSize]byte
+        if _, err := io.ReadFull(sealed, lenBuf[:]); err != nil {
+            if err == io.EOF { return errors.New("truncated stream: missing EOF frame.") }
+            return err
+        }
+        cipherLen := binary.BigEndian.Uint32(lenBuf[:])
+        if cipherLen > uint32(maxCipherLen) {
+            return errors.New("streaming envelope frame exceeds maximum allowed size.")
+        }
+
+        cipher := make([]byte, cipherLen)
+        if _, err := io.ReadFull(sealed, cipher); err != nil { return err }
+
+        nonce := streamFrameNonce(msgNumber, frame)
+        opened, success := box.OpenAfterPrecomputation(nil, cipher, &nonce, ss)
+        if !success { return errors.New("Authentication error.") }
+
+        if len(opened) == 0 { return nil }
+
+        stripped, err := StripPadding(opened)
+        if err != nil { return err }
+        if _, err := plain.Write(stripped); err != nil { return err }
+        frame++
+    }
+}
@@ -0,0 +1,43 @@
+package golesali
+
+import (
+    "bytes"
+    "crypto/rand"
+    "encoding/binary"
+    "testing"
+)
+
+func TestStreamingEnvelopeRoundTrip(t *testing.T) {
+    var ss [K_SZ]byte
+    if _, err := rand.Read(ss[:]); err != nil { t.Fatalf("ss: %v", err) }
+
+    plain := bytes.Repeat([]byte("streaming round trip "), 1000)
+
+    var sealed bytes.Buffer
+    if err := SealStreamingEnvelope(&sealed, bytes.NewReader(plain), &ss, 42, 64); err != nil {
+        t.Fatalf("SealStreamingEnvelope: %v", err)
+    }
+
+    var opened bytes.Buffer
+    if err := OpenStreamingEnvelope(&sealed, &opened, &ss, 42, 64); err != nil {
+        t.Fatalf("OpenStreamingEnvelope: %v", err)
+    }
+
+    if !bytes.Equal(opened.Bytes(), plain) {
+        t.Fatalf("round trip mismatch: got %d bytes, want %d", opened.Len(), len(plain))
+    }
+}
+
+func TestStreamingEnvelopeRejectsOversizedFrame(t *testing.T) {
+    var ss [K_SZ]byte
+    if _, err := rand.Read(ss[:]); err != nil { t.Fatalf("ss: %v", err) }
+
+    var malicious bytes.Buffer
+    var lenBuf [frameLenSize]byte
+    binary.BigEndian.PutUint32(lenBuf[:], uint32(maxStreamCipherLen(64))+1)
+    malicious.Write(lenBuf[:])
+
+    if err := OpenStreamingEnvelope(&malicious, &bytes.Buffer{}, &ss, 42, 64); err == nil {
+        t.Fatal("expected an oversized frame length to be rejected before allocating")
+    }
+}